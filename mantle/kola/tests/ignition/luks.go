@@ -1,30 +1,33 @@
 package ignition
 
 import (
+	"encoding/json"
 	"fmt"
 	"regexp"
-	"time"
 
-	"github.com/coreos/mantle/kola"
 	"github.com/coreos/mantle/kola/cluster"
 	"github.com/coreos/mantle/kola/register"
+	"github.com/coreos/mantle/kola/tests/util/tang"
 	"github.com/coreos/mantle/platform"
 	"github.com/coreos/mantle/platform/conf"
-	"github.com/coreos/mantle/platform/machine/unprivqemu"
 	"github.com/coreos/mantle/system"
-	"github.com/coreos/mantle/util"
 )
 
 func init() {
 	// Create 0 cluster size to allow starting and setup of Tang as needed per test
 	// See: https://github.com/coreos/coreos-assembler/pull/1310#discussion_r401908836
+	// NOTE: this used to also run on aws/gcp/azure/openstack/esx/etc. against
+	// a Tang guest reachable over m.PrivateIP(). The in-process Tang server
+	// only listens inside a LocalCluster network namespace, so those
+	// platforms lose coverage here until we teach them how to reach it too.
 	register.RegisterTest(&register.Test{
 		Run:         luksTangTest,
 		ClusterSize: 0,
 		Name:        `luks.tang`,
 		Flags:       []register.Flag{},
 		Distros:     []string{"rhcos"},
-		Tags:        []string{"luks", "tang", kola.NeedsInternetTag},
+		Platforms:   []string{"qemu-unpriv"},
+		Tags:        []string{"luks", "tang"},
 	})
 	register.RegisterTest(&register.Test{
 		Run:                  luksSSST1Test,
@@ -34,7 +37,7 @@ func init() {
 		Distros:              []string{"rhcos"},
 		Platforms:            []string{"qemu-unpriv"},
 		ExcludeArchitectures: []string{"s390x"}, // no TPM backend support for s390x
-		Tags:                 []string{"luks", "tpm", "tang", "sss", kola.NeedsInternetTag},
+		Tags:                 []string{"luks", "tpm", "tang", "sss"},
 	})
 	register.RegisterTest(&register.Test{
 		Run:                  luksSSST2Test,
@@ -44,87 +47,34 @@ func init() {
 		Distros:              []string{"rhcos"},
 		Platforms:            []string{"qemu-unpriv"},
 		ExcludeArchitectures: []string{"s390x"}, // no TPM backend support for s390x
-		Tags:                 []string{"luks", "tpm", "tang", "sss", kola.NeedsInternetTag},
+		Tags:                 []string{"luks", "tpm", "tang", "sss"},
+	})
+	register.RegisterTest(&register.Test{
+		Run:         luksTangOfflineTest,
+		ClusterSize: 0,
+		Name:        `luks.tang.offline`,
+		Flags:       []register.Flag{},
+		Distros:     []string{"rhcos"},
+		Platforms:   []string{"qemu-unpriv"},
+		Tags:        []string{"luks", "tang"},
+	})
+	register.RegisterTest(&register.Test{
+		Run:         luksTangRotateTest,
+		ClusterSize: 0,
+		Name:        `luks.tang.rotate`,
+		Flags:       []register.Flag{},
+		Distros:     []string{"rhcos"},
+		Platforms:   []string{"qemu-unpriv"},
+		Tags:        []string{"luks", "tang"},
 	})
 }
 
-type tangServer struct {
-	machine    platform.Machine
-	address    string
-	thumbprint string
-}
-
-func setupTangMachine(c cluster.TestCluster) tangServer {
-	var m platform.Machine
-	var err error
-	var thumbprint []byte
-	var tangAddress string
-
-	options := platform.QemuMachineOptions{
-		HostForwardPorts: []platform.HostForwardPort{
-			{Service: "ssh", HostPort: 0, GuestPort: 22},
-			{Service: "tang", HostPort: 0, GuestPort: 80},
-		},
-	}
-
-	ignition := conf.Ignition(`{
-		"ignition": {
-			"version": "3.0.0"
-		}
-	}`)
-
-	switch pc := c.Cluster.(type) {
-	// These cases have to be separated because when put together to the same case statement
-	// the golang compiler no longer checks that the individual types in the case have the
-	// NewMachineWithQemuOptions function, but rather whether platform.Cluster
-	// does which fails
-	case *unprivqemu.Cluster:
-		m, err = pc.NewMachineWithQemuOptions(ignition, options)
-		for _, hfp := range options.HostForwardPorts {
-			if hfp.Service == "tang" {
-				tangAddress = fmt.Sprintf("10.0.2.2:%d", hfp.HostPort)
-			}
-		}
-	default:
-		m, err = pc.NewMachine(ignition)
-		tangAddress = fmt.Sprintf("%s:80", m.PrivateIP())
-	}
-	if err != nil {
-		c.Fatal(err)
-	}
-
-	// TODO: move container image to centralized namespace
-	// container source: https://github.com/mike-nguyen/tang-docker-container/
-	containerImage := "quay.io/mike_nguyen/tang"
-	if system.RpmArch() != "x86_64" {
-		containerImage = "quay.io/multi-arch/tang:" + system.RpmArch()
-	}
-
-	containerID, errMsg, err := m.SSH("sudo podman run -d -p 80:80 " + containerImage)
+func setupTangMachine(c cluster.TestCluster) *tang.Harness {
+	th, err := tang.Start(c)
 	if err != nil {
-		c.Fatalf("Unable to start Tang container: %v\n%s", err, string(errMsg))
-	}
-
-	// Wait a little bit for the container to start
-	if err := util.Retry(10, time.Second, func() error {
-		cmd := fmt.Sprintf("sudo podman exec %s /usr/bin/tang-show-keys", string(containerID))
-		thumbprint, _, err = m.SSH(cmd)
-		if err != nil {
-			return err
-		}
-		if string(thumbprint) == "" {
-			return fmt.Errorf("tang-show-keys returns nothing")
-		}
-		return nil
-	}); err != nil {
-		c.Fatalf("Unable to retrieve Tang keys: %v", err)
-	}
-
-	return tangServer{
-		machine:    m,
-		address:    tangAddress,
-		thumbprint: string(thumbprint),
+		c.Fatalf("Unable to start Tang server: %v", err)
 	}
+	return th
 }
 
 func mustMatch(c cluster.TestCluster, r string, output []byte) {
@@ -147,12 +97,18 @@ func mustNotMatch(c cluster.TestCluster, r string, output []byte) {
 	}
 }
 
-func luksSanityTest(c cluster.TestCluster, tangd tangServer, m platform.Machine, tpm2, killTangAfterFirstBoot bool) {
-	rootPart := "/dev/disk/by-partlabel/root"
+// rootPartition returns the device to run cryptsetup/clevis commands
+// against.
+func rootPartition() string {
 	// hacky,  but needed for s390x because of gpt issue with naming on big endian systems: https://bugzilla.redhat.com/show_bug.cgi?id=1899990
 	if system.RpmArch() == "s390x" {
-		rootPart = "/dev/disk/by-id/virtio-primary-disk-part4"
+		return "/dev/disk/by-id/virtio-primary-disk-part4"
 	}
+	return "/dev/disk/by-partlabel/root"
+}
+
+func luksSanityTest(c cluster.TestCluster, tangd *tang.Harness, m platform.Machine, tpm2, killTangAfterFirstBoot bool) {
+	rootPart := rootPartition()
 
 	luksDump := c.MustSSH(m, "sudo cryptsetup luksDump "+rootPart)
 	// Yes, some hacky regexps.  There is luksDump --debug-json but we'd have to massage the JSON
@@ -171,7 +127,7 @@ func luksSanityTest(c cluster.TestCluster, tangd tangServer, m platform.Machine,
 	// And validate we can automatically unlock it on reboot.
 	// We kill the tang server if we're testing thresholding
 	if killTangAfterFirstBoot {
-		tangd.machine.Destroy()
+		tangd.Stop()
 	}
 	err := m.Reboot()
 	if err != nil {
@@ -181,11 +137,32 @@ func luksSanityTest(c cluster.TestCluster, tangd tangServer, m platform.Machine,
 	mustMatch(c, "Cipher: *aes", luksDump)
 }
 
-func runTest(c cluster.TestCluster, tpm2 bool, threshold int, killTangAfterFirstBoot bool) {
+func runTest(c cluster.TestCluster, tpm2 bool, threshold int, killTangAfterFirstBoot, offline bool) {
 	tangd := setupTangMachine(c)
+
+	// The advertisement field is an Ignition 3.4 addition, so only ask for
+	// it (and the newer spec version) when the test actually wants it.
+	version := "3.2.0"
+	tangEntry := fmt.Sprintf(`{
+						"url": "http://%s",
+						"thumbprint": "%s"
+					}`, tangd.URL(), tangd.Thumbprint())
+	if offline {
+		version = "3.4.0"
+		advertisement, err := json.Marshal(tangd.Advertisement())
+		if err != nil {
+			c.Fatalf("Unable to encode tang advertisement: %v", err)
+		}
+		tangEntry = fmt.Sprintf(`{
+						"url": "http://%s",
+						"thumbprint": "%s",
+						"advertisement": %s
+					}`, tangd.URL(), tangd.Thumbprint(), advertisement)
+	}
+
 	ignition := conf.Ignition(fmt.Sprintf(`{
 		"ignition": {
-			"version": "3.2.0"
+			"version": "%s"
 		},
 		"storage": {
 			"luks": [
@@ -194,12 +171,7 @@ func runTest(c cluster.TestCluster, tpm2 bool, threshold int, killTangAfterFirst
 					"device": "/dev/disk/by-label/root",
 					"clevis": {
 						"tpm2": %v,
-						"tang": [
-							{
-								"url": "http://%s",
-								"thumbprint": "%s"
-							}
-						],
+						"tang": [%s],
 						"threshold": %d
 					},
 					"label": "root",
@@ -215,7 +187,7 @@ func runTest(c cluster.TestCluster, tpm2 bool, threshold int, killTangAfterFirst
 				}
 			]
 		}
-	}`, tpm2, tangd.address, tangd.thumbprint, threshold))
+	}`, version, tpm2, tangEntry, threshold))
 
 	opts := platform.MachineOptions{
 		MinMemory: 4096,
@@ -225,24 +197,133 @@ func runTest(c cluster.TestCluster, tpm2 bool, threshold int, killTangAfterFirst
 	case "ppc64le", "aarch64":
 		opts.MinMemory = 8192
 	}
+
+	// Firewall off Tang before first boot so a successful provision can
+	// only be explained by the pre-fetched advertisement, then bring it
+	// back so the reboot unlock (which does need to talk to Tang) works.
+	if offline {
+		if err := tangd.SetBlocked(true); err != nil {
+			c.Fatalf("Unable to firewall off Tang: %v", err)
+		}
+	}
+
 	m, err := c.NewMachineWithOptions(ignition, opts)
 	if err != nil {
 		c.Fatalf("Unable to create test machine: %v", err)
 	}
+
+	if offline {
+		if err := tangd.SetBlocked(false); err != nil {
+			c.Fatalf("Unable to re-enable Tang: %v", err)
+		}
+	}
+
 	luksSanityTest(c, tangd, m, tpm2, killTangAfterFirstBoot)
 }
 
 // Verify that the rootfs is encrypted with Tang
 func luksTangTest(c cluster.TestCluster) {
-	runTest(c, false, 1, false)
+	runTest(c, false, 1, false, false)
 }
 
 // Verify that the rootfs is encrypted with SSS with t=1
 func luksSSST1Test(c cluster.TestCluster) {
-	runTest(c, true, 1, true)
+	runTest(c, true, 1, true, false)
 }
 
 // Verify that the rootfs is encrypted with SSS with t=2
 func luksSSST2Test(c cluster.TestCluster) {
-	runTest(c, true, 2, false)
+	runTest(c, true, 2, false, false)
+}
+
+// Verify that a guest can provision and unlock using only a pre-fetched
+// Tang advertisement, without reaching the Tang server on first boot.
+func luksTangOfflineTest(c cluster.TestCluster) {
+	runTest(c, false, 1, false, true)
+}
+
+// Verify the key-rotation workflow RHCOS operators have to perform when
+// NBDE keys are rolled over: rotating the Tang server's keys doesn't
+// break a guest that hasn't rebound yet, `clevis luks regen` rebinds it
+// against the new advertisement, and purging the rotated-away keys then
+// breaks unlock for a guest that hasn't rebound since the last rotation.
+// That last step is what
+// proves the earlier successful reboots were actually talking to Tang,
+// rather than succeeding for some unrelated reason.
+func luksTangRotateTest(c cluster.TestCluster) {
+	tangd := setupTangMachine(c)
+	rootPart := rootPartition()
+
+	ignition := conf.Ignition(fmt.Sprintf(`{
+		"ignition": {
+			"version": "3.2.0"
+		},
+		"storage": {
+			"luks": [
+				{
+					"name": "root",
+					"device": "/dev/disk/by-label/root",
+					"clevis": {
+						"tang": [
+							{
+								"url": "http://%s",
+								"thumbprint": "%s"
+							}
+						],
+						"threshold": 1
+					},
+					"label": "root",
+					"wipeVolume": true
+				}
+			],
+			"filesystems": [
+				{
+					"device": "/dev/mapper/root",
+					"format": "xfs",
+					"wipeFilesystem": true,
+					"label": "root"
+				}
+			]
+		}
+	}`, tangd.URL(), tangd.Thumbprint()))
+
+	m, err := c.NewMachineWithOptions(ignition, platform.MachineOptions{MinMemory: 4096})
+	if err != nil {
+		c.Fatalf("Unable to create test machine: %v", err)
+	}
+
+	luksDump := c.MustSSH(m, "sudo cryptsetup luksDump "+rootPart)
+	mustMatch(c, "0: *clevis", luksDump)
+
+	// Rotate the server's keys. The guest is still bound against the
+	// pre-rotation advertisement, but since those keys aren't purged yet
+	// a reboot should still unlock automatically.
+	if err := tangd.Rotate(); err != nil {
+		c.Fatalf("Unable to rotate Tang keys: %v", err)
+	}
+	if err := m.Reboot(); err != nil {
+		c.Fatalf("Failed to reboot after rotating Tang keys: %v", err)
+	}
+	luksDump = c.MustSSH(m, "sudo cryptsetup luksDump "+rootPart)
+	mustMatch(c, "Cipher: *aes", luksDump)
+
+	// Rebind against the now-current advertisement, and confirm unlock
+	// still works against it.
+	c.MustSSH(m, "sudo clevis luks regen -d "+rootPart+" -s 1")
+	if err := m.Reboot(); err != nil {
+		c.Fatalf("Failed to reboot after clevis luks regen: %v", err)
+	}
+	luksDump = c.MustSSH(m, "sudo cryptsetup luksDump "+rootPart)
+	mustMatch(c, "Cipher: *aes", luksDump)
+
+	// Rotate again, but this time purge the keys the guest is still
+	// bound to before it has a chance to regen against them. Automatic
+	// unlock should now fail.
+	if err := tangd.Rotate(); err != nil {
+		c.Fatalf("Unable to rotate Tang keys: %v", err)
+	}
+	tangd.Purge()
+	if err := m.Reboot(); err == nil {
+		c.Fatal("Reboot unexpectedly succeeded against purged Tang keys")
+	}
 }
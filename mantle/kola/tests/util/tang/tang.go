@@ -0,0 +1,95 @@
+// Copyright 2021 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package tang provides a reusable harness for standing up a Tang (NBDE)
+// server inside a kola test's local network namespace. It exists so that
+// LUKS/Tang/SSS tests, and any future NBDE test (rotation, key
+// regeneration, multi-server thresholding), don't each have to re-derive
+// how to get a Tang server in front of their guests.
+package tang
+
+import (
+	"fmt"
+
+	"github.com/coreos/mantle/kola/cluster"
+	"github.com/coreos/mantle/platform/local"
+)
+
+// harnessFlight is implemented by the platform flights (currently only
+// qemu-unpriv) that run kola's guests inside a local.LocalCluster network
+// namespace, and so can host a Tang server alongside them.
+type harnessFlight interface {
+	NewTangServer() (*local.TangServer, error)
+}
+
+// Harness drives a Tang server running alongside a kola test's guests.
+type Harness struct {
+	ts *local.TangServer
+}
+
+// Start launches a Tang server inside c's flight.
+func Start(c cluster.TestCluster) (*Harness, error) {
+	lf, ok := c.Cluster.Flight().(harnessFlight)
+	if !ok {
+		return nil, fmt.Errorf("platform does not support running a local Tang server")
+	}
+
+	ts, err := lf.NewTangServer()
+	if err != nil {
+		return nil, fmt.Errorf("starting tang server: %v", err)
+	}
+	return &Harness{ts: ts}, nil
+}
+
+// URL returns the ip:port guests should use to reach the server; this is
+// the guest-side SLIRP address, not the loopback address it is bound to.
+func (h *Harness) URL() string {
+	return h.ts.URL()
+}
+
+// Thumbprint returns the RFC 7638 thumbprint of the server's signing key,
+// as would be printed by tang-show-keys.
+func (h *Harness) Thumbprint() string {
+	return h.ts.Thumbprint()
+}
+
+// Advertisement returns the raw JWS advertisement document served at
+// /adv/, suitable for embedding directly into an Ignition config.
+func (h *Harness) Advertisement() string {
+	return h.ts.Advertisement()
+}
+
+// SetBlocked firewalls the server off from (or re-opens it to) the guests
+// it's serving, so tests can prove a guest provisions without reaching
+// Tang.
+func (h *Harness) SetBlocked(blocked bool) error {
+	return h.ts.SetBlocked(blocked)
+}
+
+// Rotate rolls the server over to a freshly generated signing and
+// exchange key pair, without invalidating guests bound against the
+// previous advertisement until Purge is called.
+func (h *Harness) Rotate() error {
+	return h.ts.Rotate()
+}
+
+// Purge drops every exchange key except the one currently advertised.
+func (h *Harness) Purge() {
+	h.ts.Purge()
+}
+
+// Stop tears down the server.
+func (h *Harness) Stop() error {
+	return h.ts.Destroy()
+}
@@ -0,0 +1,390 @@
+// Copyright 2021 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package local
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// tangJWK is a minimal JSON Web Key, just enough to describe the EC keys
+// a Tang server advertises and the ephemeral keys clients present to it.
+type tangJWK struct {
+	Kty    string   `json:"kty"`
+	Crv    string   `json:"crv"`
+	X      string   `json:"x"`
+	Y      string   `json:"y"`
+	Kid    string   `json:"kid,omitempty"`
+	Alg    string   `json:"alg,omitempty"`
+	KeyOps []string `json:"key_ops,omitempty"`
+}
+
+type tangSignature struct {
+	Protected string `json:"protected"`
+	Signature string `json:"signature"`
+}
+
+type tangJWS struct {
+	Payload    string          `json:"payload"`
+	Signatures []tangSignature `json:"signatures"`
+}
+
+// TangServer is a minimal implementation of the Tang NBDE server protocol
+// (see https://github.com/latchset/tang), sufficient for clevis/Ignition
+// guests to provision and unlock against in kola's LUKS tests. It is
+// started inside a LocalCluster's network namespace on a dynamically
+// allocated port, so SSS tests can run several instances side by side
+// without colliding on a fixed port the way the old Tang guest did.
+type TangServer struct {
+	lc       *LocalCluster
+	listener net.Listener
+	server   *http.Server
+
+	// mu guards every field below: Rotate/Purge run from the test's
+	// goroutine while serveAdvertisement/serveRecover run from the
+	// http.Server's goroutine(s), concurrently with a guest mid-boot.
+	mu     sync.RWMutex
+	sigKey *ecdsa.PrivateKey
+
+	// excKeys holds every exchange key the server will still perform
+	// recovery with, keyed by its JWK thumbprint (kid). Rotate adds a new
+	// one without removing the others, so guests bound against a
+	// not-yet-rotated advertisement keep working; Purge drops everything
+	// but excKid.
+	excKeys map[string]*ecdsa.PrivateKey
+	excKid  string
+
+	advertisement string
+	thumbprint    string
+}
+
+// NewTangServer starts a Tang server inside lc's network namespace and
+// returns once it is ready to serve requests.
+func (lc *LocalCluster) NewTangServer() (*TangServer, error) {
+	nsExit, err := NsEnter(lc.nshandle)
+	if err != nil {
+		return nil, err
+	}
+	defer nsExit()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("listening for tang: %v", err)
+	}
+
+	ts := &TangServer{lc: lc, listener: ln}
+	if err := ts.generateKeys(); err != nil {
+		ln.Close()
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/adv/", ts.serveAdvertisement)
+	mux.HandleFunc("/rec/", ts.serveRecover)
+	ts.server = &http.Server{Handler: mux}
+
+	go ts.server.Serve(ln)
+
+	return ts, nil
+}
+
+// generateKeys creates the server's first signing and exchange key pair
+// and builds the advertisement JWS served at /adv/.
+func (ts *TangServer) generateKeys() error {
+	ts.excKeys = map[string]*ecdsa.PrivateKey{}
+	return ts.Rotate()
+}
+
+// Rotate generates a new signing and exchange key pair and makes it the
+// one served at /adv/. Previously-rotated exchange keys are kept around
+// so guests that provisioned against an older advertisement can still
+// recover their passphrase, right up until Purge drops them; this mirrors
+// the signing/exchange key rollover real Tang deployments do with
+// tang-show-keys and the hidden keys directory.
+func (ts *TangServer) Rotate() error {
+	sigKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return fmt.Errorf("generating tang signing key: %v", err)
+	}
+	excKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return fmt.Errorf("generating tang exchange key: %v", err)
+	}
+
+	sigJWK, err := jwkFromPrivate(sigKey, "sig")
+	if err != nil {
+		return err
+	}
+	excJWK, err := jwkFromPrivate(excKey, "derive")
+	if err != nil {
+		return err
+	}
+
+	thumbprint, err := jwkThumbprint(sigJWK)
+	if err != nil {
+		return err
+	}
+
+	adv, err := signAdvertisement(sigKey, []tangJWK{sigJWK, excJWK})
+	if err != nil {
+		return err
+	}
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.sigKey = sigKey
+	ts.excKeys[excJWK.Kid] = excKey
+	ts.excKid = excJWK.Kid
+	ts.thumbprint = thumbprint
+	ts.advertisement = adv
+
+	return nil
+}
+
+// Purge drops every exchange key except the one currently advertised, so
+// guests still bound against an older advertisement can no longer recover
+// their passphrase from this server.
+func (ts *TangServer) Purge() {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	for kid := range ts.excKeys {
+		if kid != ts.excKid {
+			delete(ts.excKeys, kid)
+		}
+	}
+}
+
+// jwkFromPrivate renders the public half of key as a JWK. A use of "sig"
+// sets key_ops to "verify"; any other use sets it to "deriveKey".
+func jwkFromPrivate(key *ecdsa.PrivateKey, use string) (tangJWK, error) {
+	size := (key.Curve.Params().BitSize + 7) / 8
+	x := make([]byte, size)
+	y := make([]byte, size)
+	key.X.FillBytes(x)
+	key.Y.FillBytes(y)
+
+	jwk := tangJWK{
+		Kty: "EC",
+		Crv: "P-256",
+		X:   base64.RawURLEncoding.EncodeToString(x),
+		Y:   base64.RawURLEncoding.EncodeToString(y),
+	}
+	if use == "sig" {
+		jwk.KeyOps = []string{"verify"}
+	} else {
+		jwk.KeyOps = []string{"deriveKey"}
+	}
+	thumbprint, err := jwkThumbprint(jwk)
+	if err != nil {
+		return tangJWK{}, err
+	}
+	jwk.Kid = thumbprint
+	return jwk, nil
+}
+
+// jwkThumbprint computes the RFC 7638 JWK thumbprint of an EC key. Go's
+// json.Marshal already emits map keys in sorted order, which for an EC
+// key happens to match the member order the RFC requires.
+func jwkThumbprint(jwk tangJWK) (string, error) {
+	canonical := map[string]string{
+		"crv": jwk.Crv,
+		"kty": jwk.Kty,
+		"x":   jwk.X,
+		"y":   jwk.Y,
+	}
+	b, err := json.Marshal(canonical)
+	if err != nil {
+		return "", fmt.Errorf("marshaling jwk for thumbprint: %v", err)
+	}
+	sum := sha256.Sum256(b)
+	return base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
+
+// signAdvertisement builds the JWS document Tang serves at /adv/: a JWK
+// Set containing keys, signed by sigKey with ES256.
+func signAdvertisement(sigKey *ecdsa.PrivateKey, keys []tangJWK) (string, error) {
+	payload, err := json.Marshal(struct {
+		Keys []tangJWK `json:"keys"`
+	}{Keys: keys})
+	if err != nil {
+		return "", fmt.Errorf("marshaling tang keyset: %v", err)
+	}
+	payloadB64 := base64.RawURLEncoding.EncodeToString(payload)
+
+	protected := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"ES256"}`))
+	signingInput := protected + "." + payloadB64
+
+	r, s, err := ecdsaSign(sigKey, signingInput)
+	if err != nil {
+		return "", err
+	}
+
+	jws := tangJWS{
+		Payload: payloadB64,
+		Signatures: []tangSignature{
+			{Protected: protected, Signature: base64.RawURLEncoding.EncodeToString(append(r, s...))},
+		},
+	}
+	b, err := json.Marshal(jws)
+	if err != nil {
+		return "", fmt.Errorf("marshaling tang advertisement: %v", err)
+	}
+	return string(b), nil
+}
+
+// ecdsaSign signs input with key and returns the fixed-width r and s
+// values as used by JWS ES256 signatures (RFC 7518 section 3.4).
+func ecdsaSign(key *ecdsa.PrivateKey, input string) ([]byte, []byte, error) {
+	digest := sha256.Sum256([]byte(input))
+	r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+	if err != nil {
+		return nil, nil, fmt.Errorf("signing tang advertisement: %v", err)
+	}
+	size := (key.Curve.Params().BitSize + 7) / 8
+	rb := make([]byte, size)
+	sb := make([]byte, size)
+	r.FillBytes(rb)
+	s.FillBytes(sb)
+	return rb, sb, nil
+}
+
+func (ts *TangServer) serveAdvertisement(w http.ResponseWriter, r *http.Request) {
+	ts.mu.RLock()
+	advertisement := ts.advertisement
+	ts.mu.RUnlock()
+
+	w.Header().Set("Content-Type", "application/jose+json")
+	fmt.Fprint(w, advertisement)
+}
+
+// serveRecover implements Tang's unauthenticated ECMR key recovery: the
+// client POSTs its ephemeral public key as a raw JWK to /rec/<kid>, and we
+// return the point resulting from multiplying it by the scalar of the
+// exchange key identified by kid. The client then combines that point
+// with the blinding it applied locally to recover the bound secret. kid
+// is looked up in excKeys, which still holds rotated-but-not-yet-purged
+// keys, so guests don't need to re-provision on every rotation.
+func (ts *TangServer) serveRecover(w http.ResponseWriter, r *http.Request) {
+	kid := strings.TrimPrefix(r.URL.Path, "/rec/")
+	ts.mu.RLock()
+	excKey, ok := ts.excKeys[kid]
+	ts.mu.RUnlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	var clientKey tangJWK
+	if err := json.NewDecoder(r.Body).Decode(&clientKey); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	x, err := base64.RawURLEncoding.DecodeString(clientKey.X)
+	if err != nil {
+		http.Error(w, "bad x coordinate", http.StatusBadRequest)
+		return
+	}
+	y, err := base64.RawURLEncoding.DecodeString(clientKey.Y)
+	if err != nil {
+		http.Error(w, "bad y coordinate", http.StatusBadRequest)
+		return
+	}
+
+	curve := elliptic.P256()
+	px := new(big.Int).SetBytes(x)
+	py := new(big.Int).SetBytes(y)
+	sx, sy := curve.ScalarMult(px, py, excKey.D.Bytes())
+
+	size := (curve.Params().BitSize + 7) / 8
+	sxb := make([]byte, size)
+	syb := make([]byte, size)
+	sx.FillBytes(sxb)
+	sy.FillBytes(syb)
+
+	reply := tangJWK{
+		Kty: "EC",
+		Crv: "P-256",
+		X:   base64.RawURLEncoding.EncodeToString(sxb),
+		Y:   base64.RawURLEncoding.EncodeToString(syb),
+	}
+	w.Header().Set("Content-Type", "application/jwk+json")
+	json.NewEncoder(w).Encode(reply)
+}
+
+// URL returns the address guests should use to reach the server. qemu-unpriv
+// guests sit behind QEMU's SLIRP usermode networking, which transparently
+// forwards a guest connection to 10.0.2.2:<port> through to the matching
+// port on the host (here, inside lc's network namespace), so we advertise
+// that address rather than the loopback one we actually bound.
+func (ts *TangServer) URL() string {
+	_, port, err := net.SplitHostPort(ts.listener.Addr().String())
+	if err != nil {
+		// listener.Addr() is always host:port for a TCP listener.
+		panic(err)
+	}
+	return net.JoinHostPort("10.0.2.2", port)
+}
+
+// Thumbprint returns the RFC 7638 thumbprint of the server's signing key,
+// as would be printed by tang-show-keys.
+func (ts *TangServer) Thumbprint() string {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+	return ts.thumbprint
+}
+
+// Advertisement returns the raw JWS advertisement document served at
+// /adv/, suitable for embedding directly into an Ignition config.
+func (ts *TangServer) Advertisement() string {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+	return ts.advertisement
+}
+
+// Destroy stops the server and releases its listener.
+func (ts *TangServer) Destroy() error {
+	return ts.server.Close()
+}
+
+// SetBlocked adds or removes an INPUT rule in the server's network
+// namespace that drops traffic to its port, so tests can prove that a
+// guest provisions without reaching Tang.
+func (ts *TangServer) SetBlocked(blocked bool) error {
+	_, port, err := net.SplitHostPort(ts.URL())
+	if err != nil {
+		return fmt.Errorf("splitting tang address: %v", err)
+	}
+
+	action := "-I"
+	if !blocked {
+		action = "-D"
+	}
+	cmd := ts.lc.NewCommand("iptables", action, "INPUT", "-p", "tcp", "--dport", port, "-j", "DROP")
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("setting tang firewall rule: %v", err)
+	}
+	return nil
+}